@@ -0,0 +1,645 @@
+package bson
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	tD       = reflect.TypeOf(D{})
+	tM       = reflect.TypeOf(M{})
+	tDocElem = reflect.TypeOf(DocElem{})
+	tPrimD   = reflect.TypeOf(primitive.D{})
+	tPrimE   = reflect.TypeOf(primitive.E{})
+	tPrimM   = reflect.TypeOf(primitive.M{})
+)
+
+func init() {
+	// bson.Marshal/bson.Unmarshal (the "new driver" in this package's
+	// tests) default to bson.DefaultRegistry. Without this, they have no
+	// codec for D/M/DocElem or the legacy types in legacy_types.go and
+	// fall back to generic reflection, which doesn't round-trip them the
+	// same way this package's own Marshal/Unmarshal (mgo's native D/M/
+	// DocElem support) does. Installing the compat registry here is what
+	// makes NewCompatRegistry's codecs reachable from ordinary bson.Marshal/
+	// bson.Unmarshal calls, not just from callers that build their own
+	// registry.
+	bson.DefaultRegistry = NewCompatRegistry()
+}
+
+// NewCompatRegistry returns a *bsoncodec.Registry equivalent to the
+// mongo-driver's default registry, except that D, M, DocElem and their
+// primitive.D/primitive.E/primitive.M equivalents are encoded and decoded
+// through ReflectionFreeDCodec rather than the driver's default
+// reflection-based map/slice codecs, and that the legacy types in
+// legacy_types.go get the codecs registerLegacyTypeCodecs adds. Marshaling large arrays of documents
+// spends most of its time walking reflect.Value for exactly these types,
+// so opting into this registry (e.g. as the "registry" session/client
+// option) avoids that cost without changing the wire format.
+func NewCompatRegistry() *bsoncodec.Registry {
+	rb := bson.NewRegistryBuilder()
+	registerLegacyTypeCodecs(rb)
+
+	codec := &ReflectionFreeDCodec{}
+
+	rb.RegisterEncoder(tD, codec).
+		RegisterEncoder(tM, codec).
+		RegisterEncoder(tDocElem, codec).
+		RegisterEncoder(tPrimD, codec).
+		RegisterEncoder(tPrimE, codec).
+		RegisterEncoder(tPrimM, codec).
+		RegisterDecoder(tD, codec).
+		RegisterDecoder(tM, codec).
+		RegisterDecoder(tDocElem, codec).
+		RegisterDecoder(tPrimD, codec).
+		RegisterDecoder(tPrimE, codec).
+		RegisterDecoder(tPrimM, codec)
+
+	return rb.Build()
+}
+
+// ReflectionFreeDCodec is a bsoncodec.ValueEncoder/bsoncodec.ValueDecoder
+// for D, M, DocElem, primitive.D, primitive.E and primitive.M that avoids
+// reflect-based field/key iteration on the element values: it type-switches
+// on each element's concrete Go type and calls the matching typed
+// bsonrw.ValueWriter method directly. Types it doesn't recognize (custom
+// structs nested inside a D, for example) are handed back to the
+// context's registry so behavior for anything unusual is unchanged.
+type ReflectionFreeDCodec struct{}
+
+var (
+	_ bsoncodec.ValueEncoder = (*ReflectionFreeDCodec)(nil)
+	_ bsoncodec.ValueDecoder = (*ReflectionFreeDCodec)(nil)
+)
+
+func (c *ReflectionFreeDCodec) EncodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if !val.IsValid() {
+		return vw.WriteNull()
+	}
+
+	switch v := val.Interface().(type) {
+	case D:
+		return c.encodeDoc(ec, vw, docElemsFromD(v))
+	case primitive.D:
+		return c.encodeDoc(ec, vw, docElemsFromPrimitiveD(v))
+	case DocElem:
+		return c.encodeDoc(ec, vw, []docElem{{v.Name, v.Value}})
+	case primitive.E:
+		return c.encodeDoc(ec, vw, []docElem{{v.Key, v.Value}})
+	case M:
+		return c.encodeDoc(ec, vw, docElemsFromM(v))
+	case primitive.M:
+		return c.encodeDoc(ec, vw, docElemsFromPrimitiveM(v))
+	}
+
+	return fmt.Errorf("bson: ReflectionFreeDCodec cannot encode %s", val.Type())
+}
+
+type docElem struct {
+	key   string
+	value interface{}
+}
+
+func docElemsFromD(d D) []docElem {
+	out := make([]docElem, len(d))
+	for i, e := range d {
+		out[i] = docElem{e.Name, e.Value}
+	}
+	return out
+}
+
+func docElemsFromPrimitiveD(d primitive.D) []docElem {
+	out := make([]docElem, len(d))
+	for i, e := range d {
+		out[i] = docElem{e.Key, e.Value}
+	}
+	return out
+}
+
+func docElemsFromM(m M) []docElem {
+	out := make([]docElem, 0, len(m))
+	for k, v := range m {
+		out = append(out, docElem{k, v})
+	}
+	return out
+}
+
+func docElemsFromPrimitiveM(m primitive.M) []docElem {
+	out := make([]docElem, 0, len(m))
+	for k, v := range m {
+		out = append(out, docElem{k, v})
+	}
+	return out
+}
+
+func (c *ReflectionFreeDCodec) encodeDoc(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, elems []docElem) error {
+	dw, err := vw.WriteDocument()
+	if err != nil {
+		return err
+	}
+
+	return c.encodeDocElems(ec, dw, elems)
+}
+
+// encodeDocElems writes elems onto an already-opened bsonrw.DocumentWriter
+// and closes it. It's split out from encodeDoc so that WriteCodeWithScope's
+// DocumentWriter (which isn't a bsonrw.ValueWriter and so can't go through
+// encodeDoc) can share the same element-writing loop.
+func (c *ReflectionFreeDCodec) encodeDocElems(ec bsoncodec.EncodeContext, dw bsonrw.DocumentWriter, elems []docElem) error {
+	for _, elem := range elems {
+		evw, err := dw.WriteDocumentElement(elem.key)
+		if err != nil {
+			return err
+		}
+		if err := c.encodeValue(ec, evw, elem.value); err != nil {
+			return err
+		}
+	}
+
+	return dw.WriteDocumentEnd()
+}
+
+func (c *ReflectionFreeDCodec) encodeArray(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, elems []interface{}) error {
+	aw, err := vw.WriteArray()
+	if err != nil {
+		return err
+	}
+
+	for _, elem := range elems {
+		evw, err := aw.WriteArrayElement()
+		if err != nil {
+			return err
+		}
+		if err := c.encodeValue(ec, evw, elem); err != nil {
+			return err
+		}
+	}
+
+	return aw.WriteArrayEnd()
+}
+
+// encodeValue writes a single element value without going through
+// reflect.Value, falling back to the registry's default encoder for any
+// type it doesn't have a direct writer for.
+func (c *ReflectionFreeDCodec) encodeValue(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		return vw.WriteNull()
+	case D:
+		return c.encodeDoc(ec, vw, docElemsFromD(val))
+	case primitive.D:
+		return c.encodeDoc(ec, vw, docElemsFromPrimitiveD(val))
+	case M:
+		return c.encodeDoc(ec, vw, docElemsFromM(val))
+	case primitive.M:
+		return c.encodeDoc(ec, vw, docElemsFromPrimitiveM(val))
+	case []interface{}:
+		return c.encodeArray(ec, vw, val)
+	case primitive.A:
+		return c.encodeArray(ec, vw, []interface{}(val))
+	case string:
+		return vw.WriteString(val)
+	case int32:
+		return vw.WriteInt32(val)
+	case int64:
+		return vw.WriteInt64(val)
+	case int:
+		return vw.WriteInt64(int64(val))
+	case float64:
+		return vw.WriteDouble(val)
+	case bool:
+		return vw.WriteBoolean(val)
+	case time.Time:
+		return vw.WriteDateTime(val.UnixNano() / int64(time.Millisecond))
+	case primitive.ObjectID:
+		return vw.WriteObjectID(val)
+	case ObjectId:
+		oid, err := primitive.ObjectIDFromHex(val.Hex())
+		if err != nil {
+			return err
+		}
+		return vw.WriteObjectID(oid)
+	case []byte:
+		return vw.WriteBinary(val)
+	case primitive.Binary:
+		return vw.WriteBinaryWithSubtype(val.Data, val.Subtype)
+	case primitive.Regex:
+		return vw.WriteRegex(val.Pattern, val.Options)
+	case primitive.JavaScript:
+		return vw.WriteJavascript(string(val))
+	case primitive.CodeWithScope:
+		return c.encodeCodeWithScope(ec, vw, val)
+	case primitive.Symbol:
+		return vw.WriteSymbol(string(val))
+	case primitive.DBPointer:
+		return vw.WriteDBPointer(val.DB, val.Pointer)
+	case primitive.Timestamp:
+		return vw.WriteTimestamp(val.T, val.I)
+	case primitive.Decimal128:
+		return vw.WriteDecimal128(val)
+	case primitive.Undefined:
+		return vw.WriteUndefined()
+	case primitive.MinKey:
+		return vw.WriteMinKey()
+	case primitive.MaxKey:
+		return vw.WriteMaxKey()
+	case []primitive.ObjectID:
+		return c.encodeArray(ec, vw, objectIDsToInterfaces(val))
+	case []string:
+		return c.encodeArray(ec, vw, stringsToInterfaces(val))
+	case []int32:
+		return c.encodeArray(ec, vw, int32sToInterfaces(val))
+	case []time.Time:
+		return c.encodeArray(ec, vw, timesToInterfaces(val))
+	case [][]byte:
+		return c.encodeArray(ec, vw, bytesToInterfaces(val))
+	}
+
+	// Anything else (custom structs, pointers, etc.) is handled by the
+	// registry's default, reflection-based encoder.
+	rv := reflect.ValueOf(v)
+	enc, err := ec.Registry.LookupEncoder(rv.Type())
+	if err != nil {
+		return err
+	}
+	return enc.EncodeValue(ec, vw, rv)
+}
+
+// encodeCodeWithScope writes a CodeWithScope value. Scope is typed
+// interface{} on primitive.CodeWithScope (it isn't always a primitive.D),
+// so only the document-shaped scope types this package knows how to turn
+// into docElems are supported; anything else is an error rather than a
+// silent reflection fallback, since WriteCodeWithScope's DocumentWriter
+// isn't a bsonrw.ValueWriter the registry's default encoder could use.
+func (c *ReflectionFreeDCodec) encodeCodeWithScope(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, code primitive.CodeWithScope) error {
+	var elems []docElem
+	switch scope := code.Scope.(type) {
+	case primitive.D:
+		elems = docElemsFromPrimitiveD(scope)
+	case primitive.M:
+		elems = docElemsFromPrimitiveM(scope)
+	case D:
+		elems = docElemsFromD(scope)
+	case M:
+		elems = docElemsFromM(scope)
+	default:
+		return fmt.Errorf("bson: ReflectionFreeDCodec cannot encode CodeWithScope scope of type %T", code.Scope)
+	}
+
+	dw, err := vw.WriteCodeWithScope(string(code.Code))
+	if err != nil {
+		return err
+	}
+	return c.encodeDocElems(ec, dw, elems)
+}
+
+func objectIDsToInterfaces(s []primitive.ObjectID) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func stringsToInterfaces(s []string) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func int32sToInterfaces(s []int32) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func timesToInterfaces(s []time.Time) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+func bytesToInterfaces(s [][]byte) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
+
+// DecodeValue decodes into D, M, primitive.D and primitive.M. Decoding into
+// DocElem or primitive.E, although registered, returns an error. Nested
+// documents always decode as M (primitive.M when decoding into primitive.D
+// or primitive.M), so nested maps take the outer map's type (see
+// TestMarshal_A: "if the base type is a map, all nested maps are the same
+// type"); decoding into D does not make nested documents D.
+func (c *ReflectionFreeDCodec) DecodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() {
+		return fmt.Errorf("bson: ReflectionFreeDCodec.DecodeValue cannot set value of type %s", val.Type())
+	}
+
+	switch val.Type() {
+	case tD:
+		d, err := c.decodeD(dc, vr, false)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(d))
+		return nil
+	case tPrimD:
+		d, err := c.decodeD(dc, vr, true)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(d))
+		return nil
+	case tM:
+		m, err := c.decodeM(dc, vr, false)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(m))
+		return nil
+	case tPrimM:
+		m, err := c.decodeM(dc, vr, true)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(m))
+		return nil
+	}
+
+	return fmt.Errorf("bson: ReflectionFreeDCodec cannot decode into %s", val.Type())
+}
+
+func (c *ReflectionFreeDCodec) decodeD(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, asPrimitive bool) (interface{}, error) {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeDFromReader(dc, dr, asPrimitive)
+}
+
+// decodeDFromReader builds a D/primitive.D from an already-opened
+// bsonrw.DocumentReader, so callers that obtained their DocumentReader some
+// other way (the scope ReadCodeWithScope returns, for example) don't need a
+// bsonrw.ValueReader to call ReadDocument on.
+func (c *ReflectionFreeDCodec) decodeDFromReader(dc bsoncodec.DecodeContext, dr bsonrw.DocumentReader, asPrimitive bool) (interface{}, error) {
+	var d D
+	var pd primitive.D
+
+	for {
+		key, evr, err := dr.ReadElement()
+		if err == bsonrw.ErrEOD {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := c.decodeValue(dc, evr, asPrimitive)
+		if err != nil {
+			return nil, err
+		}
+
+		if asPrimitive {
+			pd = append(pd, primitive.E{Key: key, Value: v})
+		} else {
+			d = append(d, DocElem{Name: key, Value: v})
+		}
+	}
+
+	if asPrimitive {
+		return pd, nil
+	}
+	return d, nil
+}
+
+func (c *ReflectionFreeDCodec) decodeM(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, asPrimitive bool) (interface{}, error) {
+	dr, err := vr.ReadDocument()
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeMFromReader(dc, dr, asPrimitive)
+}
+
+// decodeMFromReader builds an M/primitive.M from an already-opened
+// bsonrw.DocumentReader, mirroring decodeDFromReader, so a CodeWithScope's
+// scope (which arrives as a DocumentReader from ReadCodeWithScope) can be
+// decoded without a bsonrw.ValueReader to call ReadDocument on.
+func (c *ReflectionFreeDCodec) decodeMFromReader(dc bsoncodec.DecodeContext, dr bsonrw.DocumentReader, asPrimitive bool) (interface{}, error) {
+	m := M{}
+	pm := primitive.M{}
+
+	for {
+		key, evr, err := dr.ReadElement()
+		if err == bsonrw.ErrEOD {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := c.decodeValue(dc, evr, asPrimitive)
+		if err != nil {
+			return nil, err
+		}
+
+		if asPrimitive {
+			pm[key] = v
+		} else {
+			m[key] = v
+		}
+	}
+
+	if asPrimitive {
+		return pm, nil
+	}
+	return m, nil
+}
+
+func (c *ReflectionFreeDCodec) decodeArray(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, asPrimitive bool) (interface{}, error) {
+	ar, err := vr.ReadArray()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []interface{}
+	for {
+		evr, err := ar.ReadValue()
+		if err == bsonrw.ErrEOA {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := c.decodeValue(dc, evr, asPrimitive)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+
+	if asPrimitive {
+		return primitive.A(out), nil
+	}
+	return out, nil
+}
+
+// decodeValue decodes a single element, recursing into nested
+// documents/arrays with the same asPrimitive flag so the whole tree is
+// built out of one family of container types.
+func (c *ReflectionFreeDCodec) decodeValue(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, asPrimitive bool) (interface{}, error) {
+	switch vr.Type() {
+	case bsontype.EmbeddedDocument:
+		return c.decodeM(dc, vr, asPrimitive)
+	case bsontype.Array:
+		return c.decodeArray(dc, vr, asPrimitive)
+	case bsontype.String:
+		return vr.ReadString()
+	case bsontype.Int32:
+		return vr.ReadInt32()
+	case bsontype.Int64:
+		return vr.ReadInt64()
+	case bsontype.Double:
+		return vr.ReadDouble()
+	case bsontype.Boolean:
+		return vr.ReadBoolean()
+	case bsontype.DateTime:
+		ms, err := vr.ReadDateTime()
+		if err != nil {
+			return nil, err
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	case bsontype.ObjectID:
+		oid, err := vr.ReadObjectID()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return oid, nil
+		}
+		return ObjectIdHex(oid.Hex()), nil
+	case bsontype.Binary:
+		data, subtype, err := vr.ReadBinary()
+		if err != nil {
+			return nil, err
+		}
+		if subtype == 0x00 {
+			return data, nil
+		}
+		if asPrimitive {
+			return primitive.Binary{Subtype: subtype, Data: data}, nil
+		}
+		return Binary{Kind: subtype, Data: data}, nil
+	case bsontype.Regex:
+		pattern, options, err := vr.ReadRegex()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.Regex{Pattern: pattern, Options: options}, nil
+		}
+		return RegEx{Pattern: pattern, Options: options}, nil
+	case bsontype.JavaScript:
+		code, err := vr.ReadJavascript()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.JavaScript(code), nil
+		}
+		return JavaScript{Code: code}, nil
+	case bsontype.Symbol:
+		sym, err := vr.ReadSymbol()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.Symbol(sym), nil
+		}
+		return Symbol(sym), nil
+	case bsontype.DBPointer:
+		ns, oid, err := vr.ReadDBPointer()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.DBPointer{DB: ns, Pointer: oid}, nil
+		}
+		return DBPointer{Namespace: ns, Id: ObjectIdHex(oid.Hex())}, nil
+	case bsontype.Timestamp:
+		t, i, err := vr.ReadTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.Timestamp{T: t, I: i}, nil
+		}
+		return MongoTimestamp(int64(uint64(t)<<32 | uint64(i))), nil
+	case bsontype.Decimal128:
+		pd, err := vr.ReadDecimal128()
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return pd, nil
+		}
+		return ParseDecimal128(pd.String())
+	case bsontype.CodeWithScope:
+		code, scopeReader, err := vr.ReadCodeWithScope()
+		if err != nil {
+			return nil, err
+		}
+		scope, err := c.decodeMFromReader(dc, scopeReader, asPrimitive)
+		if err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.CodeWithScope{Code: primitive.JavaScript(code), Scope: scope.(primitive.M)}, nil
+		}
+		return JavaScript{Code: code, Scope: scope.(M)}, nil
+	case bsontype.Null:
+		return nil, vr.ReadNull()
+	case bsontype.Undefined:
+		if err := vr.ReadUndefined(); err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.Undefined{}, nil
+		}
+		return Undefined, nil
+	case bsontype.MinKey:
+		if err := vr.ReadMinKey(); err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.MinKey{}, nil
+		}
+		return MinKey, nil
+	case bsontype.MaxKey:
+		if err := vr.ReadMaxKey(); err != nil {
+			return nil, err
+		}
+		if asPrimitive {
+			return primitive.MaxKey{}, nil
+		}
+		return MaxKey, nil
+	}
+
+	return nil, fmt.Errorf("bson: ReflectionFreeDCodec cannot decode bson type %s", vr.Type())
+}
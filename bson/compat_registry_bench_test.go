@@ -0,0 +1,56 @@
+package bson
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func benchDoc() M {
+	return M{
+		"str":    "hello world",
+		"i32":    int32(123),
+		"i64":    int64(456),
+		"f64":    1.5,
+		"bool":   true,
+		"time":   time.Now().UTC(),
+		"oid":    primitive.NewObjectID(),
+		"bin":    []byte("some binary data"),
+		"regex":  primitive.Regex{Pattern: ".*", Options: "i"},
+		"nested": M{"a": int32(1), "b": "c"},
+	}
+}
+
+func benchArray(n int) M {
+	docs := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		docs[i] = benchDoc()
+	}
+	return M{"docs": docs}
+}
+
+func BenchmarkMarshal_DefaultRegistry_1kArray(b *testing.B) {
+	doc := benchArray(1000)
+	defaultRegistry := bson.NewRegistryBuilder().Build()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.MarshalWithRegistry(defaultRegistry, doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshal_CompatRegistry_1kArray(b *testing.B) {
+	doc := benchArray(1000)
+	reg := NewCompatRegistry()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bson.MarshalWithRegistry(reg, doc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
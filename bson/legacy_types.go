@@ -0,0 +1,373 @@
+package bson
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	tSymbol         = reflect.TypeOf(Symbol(""))
+	tPrimSymbol     = reflect.TypeOf(primitive.Symbol(""))
+	tJavaScript     = reflect.TypeOf(JavaScript{})
+	tPrimJSNoScope  = reflect.TypeOf(primitive.JavaScript(""))
+	tPrimCWS        = reflect.TypeOf(primitive.CodeWithScope{})
+	tBinary         = reflect.TypeOf(Binary{})
+	tPrimBinary     = reflect.TypeOf(primitive.Binary{})
+	tMongoTimestamp = reflect.TypeOf(MongoTimestamp(0))
+	tPrimTimestamp  = reflect.TypeOf(primitive.Timestamp{})
+	tDBPointer      = reflect.TypeOf(DBPointer{})
+	tPrimDBPointer  = reflect.TypeOf(primitive.DBPointer{})
+	tDecimal128     = reflect.TypeOf(Decimal128{})
+	tPrimDecimal128 = reflect.TypeOf(primitive.Decimal128{})
+
+	// MinKey, MaxKey and Undefined are package-level singleton values of
+	// unexported types, not constructible composite literals, so we key
+	// codec registration and decode results off the existing values
+	// themselves rather than a type we could name.
+	tMinKey     = reflect.TypeOf(MinKey)
+	tPrimMinKey = reflect.TypeOf(primitive.MinKey{})
+	tMaxKey     = reflect.TypeOf(MaxKey)
+	tPrimMaxKey = reflect.TypeOf(primitive.MaxKey{})
+	tUndefined  = reflect.TypeOf(Undefined)
+	tPrimUndef  = reflect.TypeOf(primitive.Undefined{})
+)
+
+// registerLegacyTypeCodecs registers bidirectional ValueEncoder/ValueDecoder
+// pairs for the old-driver BSON types other than ObjectId and RegEx that
+// have a primitive.* equivalent, so a struct field typed as either the mgo
+// form or the primitive form round-trips regardless of which driver produced
+// the bytes. ObjectId and RegEx get no codecs here; see ReflectionFreeDCodec
+// for the D/M/A container side of the shim.
+func registerLegacyTypeCodecs(rb *bsoncodec.RegistryBuilder) *bsoncodec.RegistryBuilder {
+	rb.RegisterEncoder(tSymbol, bsoncodec.ValueEncoderFunc(encodeSymbol)).
+		RegisterDecoder(tSymbol, bsoncodec.ValueDecoderFunc(decodeSymbol)).
+		RegisterEncoder(tJavaScript, bsoncodec.ValueEncoderFunc(encodeJavaScript)).
+		RegisterDecoder(tJavaScript, bsoncodec.ValueDecoderFunc(decodeJavaScript)).
+		RegisterEncoder(tBinary, bsoncodec.ValueEncoderFunc(encodeBinary)).
+		RegisterDecoder(tBinary, bsoncodec.ValueDecoderFunc(decodeBinary)).
+		RegisterEncoder(tMongoTimestamp, bsoncodec.ValueEncoderFunc(encodeMongoTimestamp)).
+		RegisterDecoder(tMongoTimestamp, bsoncodec.ValueDecoderFunc(decodeMongoTimestamp)).
+		RegisterEncoder(tDBPointer, bsoncodec.ValueEncoderFunc(encodeDBPointer)).
+		RegisterDecoder(tDBPointer, bsoncodec.ValueDecoderFunc(decodeDBPointer)).
+		RegisterEncoder(tDecimal128, bsoncodec.ValueEncoderFunc(encodeDecimal128)).
+		RegisterDecoder(tDecimal128, bsoncodec.ValueDecoderFunc(decodeDecimal128)).
+		RegisterEncoder(tMinKey, bsoncodec.ValueEncoderFunc(encodeMinKey)).
+		RegisterDecoder(tMinKey, bsoncodec.ValueDecoderFunc(decodeMinKey)).
+		RegisterEncoder(tMaxKey, bsoncodec.ValueEncoderFunc(encodeMaxKey)).
+		RegisterDecoder(tMaxKey, bsoncodec.ValueDecoderFunc(decodeMaxKey)).
+		RegisterEncoder(tUndefined, bsoncodec.ValueEncoderFunc(encodeUndefined)).
+		RegisterDecoder(tUndefined, bsoncodec.ValueDecoderFunc(decodeUndefined))
+
+	return rb
+}
+
+func encodeSymbol(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tSymbol {
+		return bsoncodec.ValueEncoderError{Name: "encodeSymbol", Types: []reflect.Type{tSymbol}, Received: val}
+	}
+	return vw.WriteSymbol(val.String())
+}
+
+func decodeSymbol(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tSymbol {
+		return bsoncodec.ValueDecoderError{Name: "decodeSymbol", Types: []reflect.Type{tSymbol}, Received: val}
+	}
+
+	var s string
+	var err error
+	switch vr.Type() {
+	case bsontype.Symbol:
+		s, err = vr.ReadSymbol()
+	default:
+		s, err = vr.ReadString()
+	}
+	if err != nil {
+		return err
+	}
+
+	val.SetString(s)
+	return nil
+}
+
+// encodeJavaScript handles mgo's JavaScript, which unlike primitive.D's
+// split JavaScript/CodeWithScope carries an optional Scope directly on the
+// one type: a nil Scope marshals as plain Javascript, a non-nil Scope
+// marshals as CodeWithScope.
+func encodeJavaScript(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tJavaScript {
+		return bsoncodec.ValueEncoderError{Name: "encodeJavaScript", Types: []reflect.Type{tJavaScript}, Received: val}
+	}
+
+	js := val.Interface().(JavaScript)
+	if js.Scope == nil {
+		return vw.WriteJavascript(js.Code)
+	}
+
+	dw, err := vw.WriteCodeWithScope(js.Code)
+	if err != nil {
+		return err
+	}
+
+	scopeType := reflect.TypeOf(js.Scope)
+	scopeEnc, err := ec.Registry.LookupEncoder(scopeType)
+	if err != nil {
+		return err
+	}
+
+	// WriteCodeWithScope's DocumentWriter isn't a bsonrw.ValueWriter, so
+	// the scope's own encoder has to be routed through WriteDocument to
+	// get one; D/M's ReflectionFreeDCodec and the driver's default map
+	// codec both do exactly that when given a ValueWriter.
+	return encodeToDocumentWriter(ec, scopeEnc, dw, reflect.ValueOf(js.Scope))
+}
+
+func decodeJavaScript(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tJavaScript {
+		return bsoncodec.ValueDecoderError{Name: "decodeJavaScript", Types: []reflect.Type{tJavaScript}, Received: val}
+	}
+
+	switch vr.Type() {
+	case bsontype.CodeWithScope:
+		code, scopeReader, err := vr.ReadCodeWithScope()
+		if err != nil {
+			return err
+		}
+
+		var scope M
+		scopeDec, err := dc.Registry.LookupDecoder(reflect.TypeOf(scope))
+		if err != nil {
+			return err
+		}
+		scopeVal := reflect.New(reflect.TypeOf(scope)).Elem()
+		if err := decodeFromDocumentReader(dc, scopeDec, scopeReader, scopeVal); err != nil {
+			return err
+		}
+
+		val.Set(reflect.ValueOf(JavaScript{Code: code, Scope: scopeVal.Interface().(M)}))
+		return nil
+	default:
+		code, err := vr.ReadJavascript()
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(JavaScript{Code: code}))
+		return nil
+	}
+}
+
+func encodeBinary(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tBinary {
+		return bsoncodec.ValueEncoderError{Name: "encodeBinary", Types: []reflect.Type{tBinary}, Received: val}
+	}
+
+	b := val.Interface().(Binary)
+	return vw.WriteBinaryWithSubtype(b.Data, b.Kind)
+}
+
+func decodeBinary(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tBinary {
+		return bsoncodec.ValueDecoderError{Name: "decodeBinary", Types: []reflect.Type{tBinary}, Received: val}
+	}
+
+	data, subtype, err := vr.ReadBinary()
+	if err != nil {
+		return err
+	}
+
+	val.Set(reflect.ValueOf(Binary{Kind: subtype, Data: data}))
+	return nil
+}
+
+func encodeMongoTimestamp(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tMongoTimestamp {
+		return bsoncodec.ValueEncoderError{Name: "encodeMongoTimestamp", Types: []reflect.Type{tMongoTimestamp}, Received: val}
+	}
+
+	ts := uint64(val.Int())
+	return vw.WriteTimestamp(uint32(ts>>32), uint32(ts))
+}
+
+func decodeMongoTimestamp(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tMongoTimestamp {
+		return bsoncodec.ValueDecoderError{Name: "decodeMongoTimestamp", Types: []reflect.Type{tMongoTimestamp}, Received: val}
+	}
+
+	t, i, err := vr.ReadTimestamp()
+	if err != nil {
+		return err
+	}
+
+	val.SetInt(int64(uint64(t)<<32 | uint64(i)))
+	return nil
+}
+
+func encodeDBPointer(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tDBPointer {
+		return bsoncodec.ValueEncoderError{Name: "encodeDBPointer", Types: []reflect.Type{tDBPointer}, Received: val}
+	}
+
+	p := val.Interface().(DBPointer)
+	oid, err := primitive.ObjectIDFromHex(p.Id.Hex())
+	if err != nil {
+		return err
+	}
+	return vw.WriteDBPointer(p.Namespace, oid)
+}
+
+func decodeDBPointer(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDBPointer {
+		return bsoncodec.ValueDecoderError{Name: "decodeDBPointer", Types: []reflect.Type{tDBPointer}, Received: val}
+	}
+
+	ns, oid, err := vr.ReadDBPointer()
+	if err != nil {
+		return err
+	}
+
+	val.Set(reflect.ValueOf(DBPointer{Namespace: ns, Id: ObjectIdHex(oid.Hex())}))
+	return nil
+}
+
+// encodeDecimal128 and decodeDecimal128 go through Decimal128.String() /
+// ParseDecimal128 rather than any bit-level accessor: mgo's Decimal128
+// keeps its high/low halves unexported with no GetBytes-style API, so the
+// only shared representation both packages expose is the decimal string.
+func encodeDecimal128(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tDecimal128 {
+		return bsoncodec.ValueEncoderError{Name: "encodeDecimal128", Types: []reflect.Type{tDecimal128}, Received: val}
+	}
+
+	d := val.Interface().(Decimal128)
+	pd, err := primitive.ParseDecimal128(d.String())
+	if err != nil {
+		return err
+	}
+	return vw.WriteDecimal128(pd)
+}
+
+func decodeDecimal128(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tDecimal128 {
+		return bsoncodec.ValueDecoderError{Name: "decodeDecimal128", Types: []reflect.Type{tDecimal128}, Received: val}
+	}
+
+	pd, err := vr.ReadDecimal128()
+	if err != nil {
+		return err
+	}
+
+	d, err := ParseDecimal128(pd.String())
+	if err != nil {
+		return err
+	}
+
+	val.Set(reflect.ValueOf(d))
+	return nil
+}
+
+func encodeMinKey(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tMinKey {
+		return bsoncodec.ValueEncoderError{Name: "encodeMinKey", Types: []reflect.Type{tMinKey}, Received: val}
+	}
+	return vw.WriteMinKey()
+}
+
+func decodeMinKey(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tMinKey {
+		return bsoncodec.ValueDecoderError{Name: "decodeMinKey", Types: []reflect.Type{tMinKey}, Received: val}
+	}
+	if err := vr.ReadMinKey(); err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(MinKey))
+	return nil
+}
+
+func encodeMaxKey(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tMaxKey {
+		return bsoncodec.ValueEncoderError{Name: "encodeMaxKey", Types: []reflect.Type{tMaxKey}, Received: val}
+	}
+	return vw.WriteMaxKey()
+}
+
+func decodeMaxKey(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tMaxKey {
+		return bsoncodec.ValueDecoderError{Name: "decodeMaxKey", Types: []reflect.Type{tMaxKey}, Received: val}
+	}
+	if err := vr.ReadMaxKey(); err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(MaxKey))
+	return nil
+}
+
+func encodeUndefined(ec bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+	if val.Type() != tUndefined {
+		return bsoncodec.ValueEncoderError{Name: "encodeUndefined", Types: []reflect.Type{tUndefined}, Received: val}
+	}
+	return vw.WriteUndefined()
+}
+
+func decodeUndefined(dc bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+	if !val.CanSet() || val.Type() != tUndefined {
+		return bsoncodec.ValueDecoderError{Name: "decodeUndefined", Types: []reflect.Type{tUndefined}, Received: val}
+	}
+	if err := vr.ReadUndefined(); err != nil {
+		return err
+	}
+	val.Set(reflect.ValueOf(Undefined))
+	return nil
+}
+
+// encodeToDocumentWriter runs enc against an already-opened
+// bsonrw.DocumentWriter by wrapping it behind a bsonrw.ValueWriter that
+// only implements WriteDocument, which is all a map/D-shaped scope needs.
+func encodeToDocumentWriter(ec bsoncodec.EncodeContext, enc bsoncodec.ValueEncoder, dw bsonrw.DocumentWriter, val reflect.Value) error {
+	vw := &preOpenedDocumentWriter{dw: dw}
+	return enc.EncodeValue(ec, vw, val)
+}
+
+// decodeFromDocumentReader is encodeToDocumentWriter's read-side
+// counterpart, used for the scope of a CodeWithScope value.
+func decodeFromDocumentReader(dc bsoncodec.DecodeContext, dec bsoncodec.ValueDecoder, dr bsonrw.DocumentReader, val reflect.Value) error {
+	vr := &preOpenedDocumentReader{dr: dr}
+	return dec.DecodeValue(dc, vr, val)
+}
+
+// preOpenedDocumentWriter adapts a bsonrw.DocumentWriter that has already
+// been opened (e.g. by WriteCodeWithScope) into the bsonrw.ValueWriter
+// shape a ValueEncoder expects, so it can be handed a scope value exactly
+// as if it were writing an ordinary embedded document.
+type preOpenedDocumentWriter struct {
+	bsonrw.ValueWriter
+	dw   bsonrw.DocumentWriter
+	used bool
+}
+
+func (w *preOpenedDocumentWriter) WriteDocument() (bsonrw.DocumentWriter, error) {
+	if w.used {
+		return nil, fmt.Errorf("bson: preOpenedDocumentWriter.WriteDocument called more than once")
+	}
+	w.used = true
+	return w.dw, nil
+}
+
+// preOpenedDocumentReader is preOpenedDocumentWriter's read-side
+// counterpart, wrapping a bsonrw.DocumentReader already opened by
+// ReadCodeWithScope.
+type preOpenedDocumentReader struct {
+	bsonrw.ValueReader
+	dr bsonrw.DocumentReader
+}
+
+func (r *preOpenedDocumentReader) Type() bsontype.Type {
+	return bsontype.EmbeddedDocument
+}
+
+func (r *preOpenedDocumentReader) ReadDocument() (bsonrw.DocumentReader, error) {
+	return r.dr, nil
+}
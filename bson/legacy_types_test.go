@@ -0,0 +1,242 @@
+package bson
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type PSymbolStruct struct {
+	Value primitive.Symbol `bson:"value,omitempty"`
+}
+
+type BSymbolStruct struct {
+	Value Symbol `bson:"value,omitempty"`
+}
+
+func TestMarshal_Symbol(t *testing.T) {
+	p := PSymbolStruct{Value: primitive.Symbol("sym")}
+	b := BSymbolStruct{Value: Symbol("sym")}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+type PJavaScriptStruct struct {
+	Value primitive.JavaScript `bson:"value,omitempty"`
+}
+
+type BJavaScriptStruct struct {
+	Value JavaScript `bson:"value,omitempty"`
+}
+
+func TestMarshal_JavaScript(t *testing.T) {
+	p := PJavaScriptStruct{Value: primitive.JavaScript("function() {}")}
+	b := BJavaScriptStruct{Value: JavaScript{Code: "function() {}"}}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+// mgo's JavaScript carries an optional Scope on the same type, unlike the
+// new driver's separate JavaScript/CodeWithScope; a non-nil Scope is what
+// selects CodeWithScope on the wire.
+type PCodeWithScopeStruct struct {
+	Value primitive.CodeWithScope `bson:"value,omitempty"`
+}
+
+type BJavaScriptWithScopeStruct struct {
+	Value JavaScript `bson:"value,omitempty"`
+}
+
+func TestMarshal_JavaScriptWithScope(t *testing.T) {
+	p := PCodeWithScopeStruct{
+		Value: primitive.CodeWithScope{
+			Code:  "function() { return x; }",
+			Scope: primitive.M{"x": int32(1)},
+		},
+	}
+	b := BJavaScriptWithScopeStruct{
+		Value: JavaScript{
+			Code:  "function() { return x; }",
+			Scope: M{"x": int32(1)},
+		},
+	}
+
+	CheckMarshal(t, p, b)
+}
+
+type PBinaryStruct struct {
+	Value primitive.Binary `bson:"value,omitempty"`
+}
+
+type BBinaryStruct struct {
+	Value Binary `bson:"value,omitempty"`
+}
+
+func TestMarshal_Binary(t *testing.T) {
+	p := PBinaryStruct{Value: primitive.Binary{Subtype: 0x80, Data: []byte{1, 2, 3}}}
+	b := BBinaryStruct{Value: Binary{Kind: 0x80, Data: []byte{1, 2, 3}}}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+type PTimestampStruct struct {
+	Value primitive.Timestamp `bson:"value,omitempty"`
+}
+
+type BMongoTimestampStruct struct {
+	Value MongoTimestamp `bson:"value,omitempty"`
+}
+
+func TestMarshal_MongoTimestamp(t *testing.T) {
+	p := PTimestampStruct{Value: primitive.Timestamp{T: 100, I: 1}}
+	b := BMongoTimestampStruct{Value: MongoTimestamp(int64(100)<<32 | int64(1))}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+type PDBPointerStruct struct {
+	Value primitive.DBPointer `bson:"value,omitempty"`
+}
+
+type BDBPointerStruct struct {
+	Value DBPointer `bson:"value,omitempty"`
+}
+
+func TestMarshal_DBPointer(t *testing.T) {
+	oid := primitive.NewObjectID()
+
+	p := PDBPointerStruct{Value: primitive.DBPointer{DB: "db.coll", Pointer: oid}}
+	b := BDBPointerStruct{Value: DBPointer{Namespace: "db.coll", Id: ObjectIdHex(oid.Hex())}}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+type PDecimal128Struct struct {
+	Value primitive.Decimal128 `bson:"value,omitempty"`
+}
+
+type BDecimal128Struct struct {
+	Value Decimal128 `bson:"value,omitempty"`
+}
+
+func TestMarshal_Decimal128(t *testing.T) {
+	d, err := primitive.ParseDecimal128("100")
+	assert.NoError(t, err)
+
+	bd, err := ParseDecimal128(d.String())
+	assert.NoError(t, err)
+
+	p := PDecimal128Struct{Value: d}
+	b := BDecimal128Struct{Value: bd}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+// Min and Max deliberately omit ,omitempty: primitive.MinKey{}/MaxKey{} are
+// zero-sized structs the driver's default omitempty treats as always-empty,
+// which would drop them from the p-side document while the b-side (holding
+// non-zero singleton values) keeps them, desyncing the two wire outputs.
+type PMinMaxKeyStruct struct {
+	Min primitive.MinKey `bson:"min"`
+	Max primitive.MaxKey `bson:"max"`
+}
+
+// MinKey and MaxKey are singleton values of unexported mgo types, not
+// constructible types themselves, so a struct field that holds one has to
+// be typed as interface{} rather than named directly.
+type BMinMaxKeyStruct struct {
+	Min interface{} `bson:"min"`
+	Max interface{} `bson:"max"`
+}
+
+func TestMarshal_MinMaxKey(t *testing.T) {
+	p := PMinMaxKeyStruct{Min: primitive.MinKey{}, Max: primitive.MaxKey{}}
+	b := BMinMaxKeyStruct{Min: MinKey, Max: MaxKey}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+// Value likewise omits ,omitempty: primitive.Undefined{} is a zero-sized
+// struct that omitempty always treats as empty, which would drop it from
+// the p-side document while the b-side's singleton value keeps it.
+type PUndefinedStruct struct {
+	Value primitive.Undefined `bson:"value"`
+}
+
+// Undefined is likewise a singleton value of an unexported type.
+type BUndefinedStruct struct {
+	Value interface{} `bson:"value"`
+}
+
+func TestMarshal_Undefined(t *testing.T) {
+	p := PUndefinedStruct{Value: primitive.Undefined{}}
+	b := BUndefinedStruct{Value: Undefined}
+
+	CheckMarshalAndUnmarshal(t, p, b)
+}
+
+func TestMarshal_Symbol_NilIntoNewNonPointer(t *testing.T) {
+	// Mirrors the ObjectID "nil id into new non-pointer" case: a nil
+	// *primitive.Symbol field, written as null, should error when decoded
+	// into a non-pointer primitive.Symbol field, not silently decode a zero
+	// value.
+	type Struct struct {
+		Value *primitive.Symbol `bson:"value"`
+	}
+
+	data, err := Marshal(Struct{Value: nil})
+	assert.NoError(t, err)
+
+	type Struct2 struct {
+		Value primitive.Symbol `bson:"value"`
+	}
+
+	{
+		var s2 Struct2
+		err = Unmarshal(data, &s2)
+		assert.Error(t, err)
+	}
+
+	{
+		var s2 Struct2
+		err = bson.Unmarshal(data, &s2)
+		assert.Error(t, err)
+	}
+}
+
+func TestMarshal_D_WithLegacyTypes(t *testing.T) {
+	t.Run("primitive.D containing legacy types unmarshals into mgo M with mgo variants", func(t *testing.T) {
+		oid := primitive.NewObjectID()
+
+		p := primitive.D{
+			{Key: "symbol", Value: primitive.Symbol("sym")},
+			{Key: "js", Value: primitive.JavaScript("function() {}")},
+			{Key: "binary", Value: primitive.Binary{Subtype: 0x80, Data: []byte{1, 2, 3}}},
+			{Key: "timestamp", Value: primitive.Timestamp{T: 100, I: 1}},
+			{Key: "pointer", Value: primitive.DBPointer{DB: "db.coll", Pointer: oid}},
+			{Key: "min", Value: primitive.MinKey{}},
+			{Key: "max", Value: primitive.MaxKey{}},
+		}
+
+		data, err := Marshal(p)
+		assert.NoError(t, err)
+
+		m := M{}
+		err = Unmarshal(data, &m)
+		assert.NoError(t, err)
+
+		expected := M{
+			"symbol":    Symbol("sym"),
+			"js":        JavaScript{Code: "function() {}"},
+			"binary":    Binary{Kind: 0x80, Data: []byte{1, 2, 3}},
+			"timestamp": MongoTimestamp(int64(100)<<32 | int64(1)),
+			"pointer":   DBPointer{Namespace: "db.coll", Id: ObjectIdHex(oid.Hex())},
+			"min":       MinKey,
+			"max":       MaxKey,
+		}
+
+		assert.Equal(t, expected, m)
+	})
+}
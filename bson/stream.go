@@ -0,0 +1,292 @@
+package bson
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// TokenType identifies the kind of event yielded by TokenDecoder.Token.
+type TokenType int
+
+const (
+	// BeginDocument is emitted once, for the top-level document a
+	// TokenDecoder was constructed to read.
+	BeginDocument TokenType = iota
+	// EndDocument is emitted when a document (top-level or entered via a
+	// ValueToken) has been fully read.
+	EndDocument
+	// BeginArray is reserved for symmetry with BeginDocument; a
+	// TokenDecoder always starts on a document, so in practice an array
+	// is only ever entered via a ValueToken, not announced with this.
+	BeginArray
+	// EndArray is emitted when an array entered via a ValueToken has
+	// been fully read.
+	EndArray
+	// KeyToken is emitted for each document element key, immediately
+	// before the Token carrying its value.
+	KeyToken
+	// ValueToken is emitted for every element value, scalar or
+	// container alike; see Token.Value.
+	ValueToken
+)
+
+// Token is a single decoding event produced by TokenDecoder.Token. Exactly
+// one of its fields is meaningful for a given Type: Key for KeyToken, Value
+// for ValueToken.
+type Token struct {
+	Type  TokenType
+	Key   string
+	Value RawValue
+}
+
+// RawValue is an undecoded BSON value paired with a reader positioned to
+// read it. Callers that want the fully decoded Go value call Unmarshal;
+// callers that don't care about this value call Skip to advance past it
+// without allocating. Either call consumes the value in one shot,
+// including a document or array value and everything nested inside it.
+//
+// A document- or array-typed value can instead be streamed: if the caller
+// calls TokenDecoder.Token again without calling Unmarshal or Skip on the
+// RawValue first, the decoder enters the container itself, and subsequent
+// Tokens are that container's own Key/Value pairs or elements, ending with
+// a matching EndDocument/EndArray.
+type RawValue struct {
+	vr  bsonrw.ValueReader
+	dec *TokenDecoder
+}
+
+// Unmarshal decodes this value into v using the same reflection-based
+// path as the package-level Unmarshal.
+func (rv RawValue) Unmarshal(v interface{}) error {
+	err := unmarshalFromReader(rv.vr, v)
+	rv.dec.clearOpenContainer(rv.vr)
+	return err
+}
+
+// Skip advances past this value without decoding or allocating it.
+func (rv RawValue) Skip() error {
+	err := rv.vr.Skip()
+	rv.dec.clearOpenContainer(rv.vr)
+	return err
+}
+
+// TokenDecoder reads a stream of Tokens from a length-delimited BSON
+// document. NewTokenDecoder reads the whole document's bytes into memory
+// once; Token then walks those bytes without building a Go value tree the
+// way Unmarshal does. It is modeled on json.Decoder:
+// callers that want the whole document decoded into a struct or map can
+// still call Decode; callers with very large documents (e.g. a
+// change-stream aggregate with a million-element array) can call Token in
+// a loop and stream each element into their own sink instead.
+type TokenDecoder struct {
+	vr    bsonrw.ValueReader
+	stack []*frame
+	done  bool
+
+	// awaitingValue is set by nextDocumentToken right after it returns a
+	// KeyToken, so the following Token call knows to emit that element's
+	// ValueToken instead of reading the frame's next element.
+	awaitingValue bsonrw.ValueReader
+
+	// openContainer is set whenever a ValueToken for a document/array
+	// value is handed to the caller, so the following Token call knows
+	// to enter it (if the caller never consumed the RawValue) rather
+	// than continue reading the current frame. RawValue.Unmarshal/Skip
+	// clear it through clearOpenContainer when the caller consumes the
+	// value directly instead.
+	openContainer bsonrw.ValueReader
+}
+
+// frame tracks the in-progress DocumentReader/ArrayReader for one nested
+// level of the document being walked, so Token can resume exactly where it
+// left off after a caller has read or skipped an element's value.
+type frame struct {
+	isArray bool
+	dr      bsonrw.DocumentReader
+	ar      bsonrw.ArrayReader
+}
+
+// NewTokenDecoder returns a TokenDecoder that reads a single BSON document
+// (its 4-byte length prefix followed by its elements) from r.
+func NewTokenDecoder(r io.Reader) (*TokenDecoder, error) {
+	var lengthBytes [4]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(lengthBytes[:])
+	if length < 4 {
+		return nil, fmt.Errorf("bson: invalid document length %d", length)
+	}
+
+	buf := make([]byte, length)
+	copy(buf, lengthBytes[:])
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, err
+	}
+
+	return &TokenDecoder{vr: bsonrw.NewBSONDocumentReader(buf)}, nil
+}
+
+// Token returns the next decoding event. Callers drive the walk
+// themselves: a KeyToken is always followed by exactly one ValueToken. An
+// array element arrives as a ValueToken directly, with no preceding
+// KeyToken. A ValueToken for a document or array value can be consumed in
+// one shot via RawValue.Unmarshal/Skip, or streamed by calling Token
+// again; see RawValue. Token returns io.EOF once the top-level document
+// has been fully consumed.
+func (d *TokenDecoder) Token() (Token, error) {
+	if d.done {
+		return Token{}, io.EOF
+	}
+
+	if d.awaitingValue != nil {
+		evr := d.awaitingValue
+		d.awaitingValue = nil
+		return d.emitValue(evr)
+	}
+
+	if d.openContainer != nil {
+		if err := d.enterContainer(d.openContainer); err != nil {
+			return Token{}, err
+		}
+		d.openContainer = nil
+	}
+
+	if len(d.stack) == 0 {
+		dr, err := d.vr.ReadDocument()
+		if err != nil {
+			return Token{}, err
+		}
+		d.stack = append(d.stack, &frame{dr: dr})
+		return Token{Type: BeginDocument}, nil
+	}
+
+	top := d.stack[len(d.stack)-1]
+	if top.isArray {
+		return d.nextArrayToken(top)
+	}
+	return d.nextDocumentToken(top)
+}
+
+func (d *TokenDecoder) nextDocumentToken(f *frame) (Token, error) {
+	key, evr, err := f.dr.ReadElement()
+	if err == bsonrw.ErrEOD {
+		d.popFrame()
+		return Token{Type: EndDocument}, nil
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	d.awaitingValue = evr
+	return Token{Type: KeyToken, Key: key}, nil
+}
+
+func (d *TokenDecoder) nextArrayToken(f *frame) (Token, error) {
+	evr, err := f.ar.ReadValue()
+	if err == bsonrw.ErrEOA {
+		d.popFrame()
+		return Token{Type: EndArray}, nil
+	}
+	if err != nil {
+		return Token{}, err
+	}
+
+	return d.emitValue(evr)
+}
+
+func (d *TokenDecoder) popFrame() {
+	d.stack = d.stack[:len(d.stack)-1]
+	if len(d.stack) == 0 {
+		d.done = true
+	}
+}
+
+// emitValue returns a ValueToken wrapping evr, remembering it as the
+// currently open container if it's a document or array value so the next
+// Token call knows to enter it if the caller leaves it unconsumed.
+func (d *TokenDecoder) emitValue(evr bsonrw.ValueReader) (Token, error) {
+	switch evr.Type() {
+	case bsontype.EmbeddedDocument, bsontype.Array:
+		d.openContainer = evr
+	}
+	return Token{Type: ValueToken, Value: RawValue{vr: evr, dec: d}}, nil
+}
+
+// enterContainer opens evr as a document or array and pushes a frame for
+// it, so the walk continues with its own elements.
+func (d *TokenDecoder) enterContainer(evr bsonrw.ValueReader) error {
+	switch evr.Type() {
+	case bsontype.Array:
+		ar, err := evr.ReadArray()
+		if err != nil {
+			return err
+		}
+		d.stack = append(d.stack, &frame{isArray: true, ar: ar})
+	default:
+		dr, err := evr.ReadDocument()
+		if err != nil {
+			return err
+		}
+		d.stack = append(d.stack, &frame{dr: dr})
+	}
+	return nil
+}
+
+// clearOpenContainer is called by RawValue.Unmarshal/Skip once they've
+// consumed vr directly, so a later Token call doesn't also try to enter it.
+func (d *TokenDecoder) clearOpenContainer(vr bsonrw.ValueReader) {
+	if d.openContainer == vr {
+		d.openContainer = nil
+	}
+}
+
+// Decode consumes one top-level document from the stream into v, using
+// the same reflection-based path as the package-level Unmarshal. It is a
+// convenience for callers that don't need the streaming Token API, and
+// must be called before any call to Token.
+func (d *TokenDecoder) Decode(v interface{}) error {
+	return unmarshalFromReader(d.vr, v)
+}
+
+// TokenEncoder writes a stream of BSON documents to w. It is the
+// write-side counterpart to TokenDecoder, but it takes whole values, not
+// Tokens: a Token stream is re-encoded by first decoding its values
+// (RawValue.Unmarshal) into a document and passing that to Encode.
+type TokenEncoder struct {
+	w io.Writer
+}
+
+// NewTokenEncoder returns a TokenEncoder that writes BSON documents to w.
+func NewTokenEncoder(w io.Writer) *TokenEncoder {
+	return &TokenEncoder{w: w}
+}
+
+// Encode marshals v and writes it to the underlying writer.
+func (e *TokenEncoder) Encode(v interface{}) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func unmarshalFromReader(vr bsonrw.ValueReader, v interface{}) error {
+	dec, err := bson.NewDecoder(vr)
+	if err != nil {
+		return err
+	}
+	// Without this, a document decoded into a bare interface{} (as
+	// RawValue.Unmarshal callers often do for a nested value whose shape
+	// they don't know ahead of time) defaults to primitive.D; with this it
+	// is a primitive.M, the same map shape as the M this package's own
+	// Unmarshal would produce (though not the M type itself).
+	dec.DefaultDocumentM()
+	return dec.Decode(v)
+}
@@ -0,0 +1,196 @@
+package bson
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoder_Token_RoundTripsThroughEncoder(t *testing.T) {
+	src := M{
+		"name": "alice",
+		"tags": []interface{}{"a", "b", "c"},
+		"nested": M{
+			"count": int32(3),
+		},
+	}
+
+	data, err := Marshal(src)
+	assert.NoError(t, err)
+
+	// want is a plain, non-streaming round trip of the same bytes through
+	// this package's own Marshal/Unmarshal: the baseline the token-walk
+	// round trip below should match. Comparing against src directly would
+	// spuriously fail on "nested.count", since legacy Unmarshal always
+	// decodes a BSON int32 into a plain int when the target is
+	// interface{}, regardless of how the data was produced.
+	want := M{}
+	assert.NoError(t, Unmarshal(data, &want))
+
+	dec, err := NewTokenDecoder(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	enc := NewTokenEncoder(&buf)
+
+	// Walk the top-level tokens, decoding each value (nested documents and
+	// arrays included) with RawValue.Unmarshal and re-encoding the collected
+	// document, to prove the token stream carries everything needed to
+	// reconstruct the document.
+	out := M{}
+	walkInto(t, dec, out)
+
+	assert.NoError(t, enc.Encode(out))
+
+	roundTripped := M{}
+	assert.NoError(t, Unmarshal(buf.Bytes(), &roundTripped))
+	assert.Equal(t, want, roundTripped)
+}
+
+// walkInto drains a TokenDecoder's Token stream for one top-level document,
+// decoding every top-level value via RawValue.Unmarshal (nested documents
+// and arrays in one shot, without entering them), populating dst.
+func walkInto(t *testing.T, dec *TokenDecoder, dst M) {
+	t.Helper()
+
+	tok, err := dec.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, BeginDocument, tok.Type)
+
+	for {
+		tok, err = dec.Token()
+		assert.NoError(t, err)
+
+		if tok.Type == EndDocument {
+			return
+		}
+
+		assert.Equal(t, KeyToken, tok.Type)
+		key := tok.Key
+
+		tok, err = dec.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, ValueToken, tok.Type)
+
+		var v interface{}
+		assert.NoError(t, tok.Value.Unmarshal(&v))
+		dst[key] = v
+	}
+}
+
+func TestDecoder_Skip(t *testing.T) {
+	data, err := Marshal(M{
+		"keep": "yes",
+		"skip": M{"a": int32(1), "b": int32(2)},
+		"last": int32(42),
+	})
+	assert.NoError(t, err)
+
+	dec, err := NewTokenDecoder(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	tok, err := dec.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, BeginDocument, tok.Type)
+
+	seen := M{}
+	for {
+		tok, err = dec.Token()
+		assert.NoError(t, err)
+		if tok.Type == EndDocument {
+			break
+		}
+
+		key := tok.Key
+		tok, err = dec.Token()
+		assert.NoError(t, err)
+
+		if key == "skip" {
+			assert.NoError(t, tok.Value.Skip())
+			continue
+		}
+
+		var v interface{}
+		assert.NoError(t, tok.Value.Unmarshal(&v))
+		seen[key] = v
+	}
+
+	assert.Equal(t, M{"keep": "yes", "last": int32(42)}, seen)
+}
+
+// TestDecoder_LargeArray_BoundedMemory streams a synthetic document whose
+// "docs" array has a million small subdocuments and checks that draining
+// it through Token, discarding each element via Skip, does not grow the
+// heap anywhere near the size a fully buffered Unmarshal would need.
+func TestDecoder_LargeArray_BoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large synthetic document test in -short mode")
+	}
+
+	const n = 1_000_000
+	r := syntheticLargeArrayReader(n)
+
+	dec, err := NewTokenDecoder(r)
+	assert.NoError(t, err)
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	tok, err := dec.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, BeginDocument, tok.Type)
+
+	tok, err = dec.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, KeyToken, tok.Type)
+	assert.Equal(t, "docs", tok.Key)
+
+	tok, err = dec.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, ValueToken, tok.Type)
+
+	count := 0
+	for {
+		elemTok, err := dec.Token()
+		assert.NoError(t, err)
+		if elemTok.Type == EndArray {
+			break
+		}
+		assert.Equal(t, ValueToken, elemTok.Type)
+		assert.NoError(t, elemTok.Value.Skip())
+		count++
+	}
+	assert.Equal(t, n, count)
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+
+	// A fully buffered Unmarshal of this document materializes a
+	// []interface{} with a million elements; streaming with Skip should
+	// stay well under that.
+	const bound = 50 * 1024 * 1024
+	grew := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	assert.Less(t, grew, int64(bound), "resident memory grew by %d bytes decoding with Skip", grew)
+}
+
+// syntheticLargeArrayReader returns a reader over a BSON document shaped
+// like {"docs": [{"i": 0}, {"i": 1}, ...]} with n subdocuments. The
+// document is built in memory and marshaled into a single []byte up front.
+func syntheticLargeArrayReader(n int) io.Reader {
+	docs := make([]interface{}, n)
+	for i := range docs {
+		docs[i] = M{"i": int32(i)}
+	}
+
+	data, err := Marshal(M{"docs": docs})
+	if err != nil {
+		panic(err)
+	}
+
+	return bytes.NewReader(data)
+}